@@ -0,0 +1,145 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/lucas-clemente/quic-go/internal/protocol"
+	"github.com/lucas-clemente/quic-go/internal/wire"
+)
+
+// retryIntegrityTagLen is the length of the AEAD tag appended to a Retry
+// packet (RFC 9001, section 5.8).
+const retryIntegrityTagLen = 16
+
+// retryAEADKey and retryAEADNonce are the fixed AES-128-GCM key and nonce
+// used to protect Retry packets. They're defined by RFC 9001, section 5.8,
+// and are public: they let a client discard Retry packets that weren't sent
+// by a genuine QUIC server, not provide confidentiality.
+var (
+	retryAEADKey   = [16]byte{0xbe, 0x0c, 0x69, 0x0b, 0x9f, 0x66, 0x57, 0x5a, 0x1d, 0x76, 0x6b, 0x54, 0xe3, 0x68, 0xc8, 0x4e}
+	retryAEADNonce = [12]byte{0x46, 0x15, 0x99, 0xd3, 0x5d, 0x63, 0x2b, 0xf2, 0x23, 0x98, 0x25, 0xbb}
+)
+
+// classifiedPacketType describes how a datagram needs to be handled before
+// (if ever) it reaches packetUnpacker.Unpack.
+type classifiedPacketType uint8
+
+const (
+	// packetTypeProtected is any packet with an AEAD-protected payload:
+	// every long-header packet other than Retry and Version Negotiation,
+	// and all short-header packets.
+	packetTypeProtected classifiedPacketType = iota
+	packetTypeRetry
+	packetTypeVersionNegotiation
+)
+
+// packetClassifier inspects an incoming datagram before it is handed to the
+// packetUnpacker. Retry packets have no header protection and an AEAD tag
+// over a pseudo-packet rather than a payload; Version Negotiation packets
+// aren't encrypted at all. Routing them here keeps Unpack free to assume
+// every packet it sees has a real AEAD-protected payload.
+type packetClassifier struct{}
+
+// Classify determines what kind of packet data is. For anything other than
+// a Version Negotiation packet, it also parses and returns the packet's
+// header, so that callers don't need to parse it twice.
+func (packetClassifier) Classify(data []byte, shortHeaderConnIDLen int) (classifiedPacketType, *wire.Header, error) {
+	if isVersionNegotiationPacket(data) {
+		return packetTypeVersionNegotiation, nil, nil
+	}
+	hdr, err := wire.ParseHeader(bytes.NewReader(data), shortHeaderConnIDLen)
+	if err != nil {
+		return packetTypeProtected, nil, err
+	}
+	if hdr.IsLongHeader && hdr.Type == protocol.PacketTypeRetry {
+		return packetTypeRetry, hdr, nil
+	}
+	return packetTypeProtected, hdr, nil
+}
+
+// verifyRetryIntegrityTag checks the AEAD integrity tag appended to a Retry
+// packet (RFC 9001, section 5.8). data is the complete, unmodified Retry
+// packet as received; origDestConnID is the Destination Connection ID that
+// the client used in the Initial packet the Retry is responding to.
+func verifyRetryIntegrityTag(data []byte, origDestConnID protocol.ConnectionID) bool {
+	if len(data) < retryIntegrityTagLen {
+		return false
+	}
+	hdrAndToken, tag := data[:len(data)-retryIntegrityTagLen], data[len(data)-retryIntegrityTagLen:]
+
+	pseudoPacket := make([]byte, 0, 1+origDestConnID.Len()+len(hdrAndToken))
+	pseudoPacket = append(pseudoPacket, uint8(origDestConnID.Len()))
+	pseudoPacket = append(pseudoPacket, origDestConnID...)
+	pseudoPacket = append(pseudoPacket, hdrAndToken...)
+
+	block, err := aes.NewCipher(retryAEADKey[:])
+	if err != nil {
+		return false
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return false
+	}
+	expectedTag := aead.Seal(nil, retryAEADNonce[:], nil, pseudoPacket)
+	return bytes.Equal(expectedTag, tag)
+}
+
+// isVersionNegotiationPacket reports whether data is a Version Negotiation
+// packet: a long-header packet advertising version 0 (RFC 9000, section
+// 17.2.1).
+func isVersionNegotiationPacket(data []byte) bool {
+	if len(data) < 5 {
+		return false
+	}
+	return data[0]&0x80 != 0 && data[1] == 0 && data[2] == 0 && data[3] == 0 && data[4] == 0
+}
+
+// parseVersionNegotiationPacket extracts the list of versions a server
+// offers in a Version Negotiation packet (RFC 9000, section 17.2.1).
+func parseVersionNegotiationPacket(data []byte) ([]protocol.VersionNumber, error) {
+	if !isVersionNegotiationPacket(data) {
+		return nil, errors.New("not a Version Negotiation packet")
+	}
+	r := bytes.NewReader(data[5:])
+	if err := skipConnID(r); err != nil { // Destination Connection ID
+		return nil, err
+	}
+	if err := skipConnID(r); err != nil { // Source Connection ID
+		return nil, err
+	}
+	if r.Len() == 0 {
+		return nil, errors.New("Version Negotiation packet has no versions")
+	}
+	if r.Len()%4 != 0 {
+		return nil, fmt.Errorf("invalid version list length: %d bytes", r.Len())
+	}
+	versions := make([]protocol.VersionNumber, 0, r.Len()/4)
+	b := make([]byte, 4)
+	for r.Len() > 0 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		versions = append(versions, protocol.VersionNumber(binary.BigEndian.Uint32(b)))
+	}
+	return versions, nil
+}
+
+func skipConnID(r *bytes.Reader) error {
+	l, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if int(l) > r.Len() {
+		return errors.New("connection ID longer than the packet")
+	}
+	if _, err := r.Seek(int64(l), io.SeekCurrent); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package quic
+
+import (
+	"github.com/lucas-clemente/quic-go/internal/protocol"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Packet Classifier", func() {
+	var classifier packetClassifier
+
+	// The RFC 9001, section 5.8 / Appendix A.4 published Retry test vector:
+	// the Retry packet sent in response to the Initial packet in Appendix
+	// A.2, whose Destination Connection ID was origDestConnID.
+	var (
+		origDestConnID = protocol.ConnectionID{0x83, 0x94, 0xc8, 0xf0, 0x3e, 0x51, 0x57, 0x08}
+		validRetry     = []byte{
+			0xff, 0x00, 0x00, 0x00, 0x01, // first byte, version 1
+			0x00,                                                 // DCIL=0
+			0x08, 0xf0, 0x67, 0xa5, 0x50, 0x2a, 0x42, 0x62, 0xb5, // SCIL=8, SCID
+			0x74, 0x6f, 0x6b, 0x65, 0x6e, // retry token ("token")
+			0x04, 0xa2, 0x65, 0xba, 0x2e, 0xff, 0x4d, 0x82, 0x90, 0x58, 0xfb, 0x3f, 0x0f, 0x24, 0x96, 0xba, // integrity tag
+		}
+	)
+
+	It("accepts a Retry packet with a valid integrity tag", func() {
+		Expect(verifyRetryIntegrityTag(validRetry, origDestConnID)).To(BeTrue())
+	})
+
+	It("rejects a Retry packet with a corrupted integrity tag", func() {
+		corrupted := append([]byte{}, validRetry...)
+		corrupted[len(corrupted)-1] ^= 0xff
+		Expect(verifyRetryIntegrityTag(corrupted, origDestConnID)).To(BeFalse())
+	})
+
+	It("rejects a Retry packet that's shorter than the integrity tag", func() {
+		Expect(verifyRetryIntegrityTag(validRetry[:10], origDestConnID)).To(BeFalse())
+	})
+
+	It("parses a Version Negotiation packet carrying two versions", func() {
+		data := []byte{0x80, 0x00, 0x00, 0x00, 0x00} // first byte, version 0
+		data = append(data, 0x00)                    // DCIL=0
+		data = append(data, 0x00)                    // SCIL=0
+		data = append(data, 0x00, 0x00, 0x00, 0x01)  // version 1
+		data = append(data, 0xff, 0x00, 0x00, 0x1d)  // a draft version
+
+		Expect(isVersionNegotiationPacket(data)).To(BeTrue())
+		versions, err := parseVersionNegotiationPacket(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(versions).To(Equal([]protocol.VersionNumber{1, 0xff00001d}))
+	})
+
+	It("classifies a Retry packet and returns its header", func() {
+		typ, hdr, err := classifier.Classify(validRetry, origDestConnID.Len())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(typ).To(Equal(packetTypeRetry))
+		Expect(hdr.Type).To(Equal(protocol.PacketTypeRetry))
+	})
+
+	It("classifies a Version Negotiation packet without parsing a header", func() {
+		data := []byte{0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00} // header, version 0, DCIL=0, SCIL=0
+		typ, hdr, err := classifier.Classify(data, origDestConnID.Len())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(typ).To(Equal(packetTypeVersionNegotiation))
+		Expect(hdr).To(BeNil())
+	})
+})
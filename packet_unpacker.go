@@ -0,0 +1,313 @@
+package quic
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/lucas-clemente/quic-go/internal/handshake"
+	"github.com/lucas-clemente/quic-go/internal/protocol"
+	"github.com/lucas-clemente/quic-go/internal/qerr"
+	"github.com/lucas-clemente/quic-go/internal/wire"
+)
+
+// headerProtectionSampleLen is the number of bytes used to derive the header
+// protection mask (RFC 9001, section 5.4.2).
+const headerProtectionSampleLen = 16
+
+// unpackedPacket is a packet that has been decrypted and parsed.
+type unpackedPacket struct {
+	hdr             *wire.ExtendedHeader
+	packetNumber    protocol.PacketNumber
+	encryptionLevel protocol.EncryptionLevel
+	frames          []wire.Frame
+}
+
+// unpacker unpacks QUIC packets, including coalesced ones (RFC 9000, section
+// 12.2).
+type unpacker interface {
+	Unpack(hdr *wire.Header, data []byte) (*unpackedPacket, error)
+	UnpackAll(data []byte, shortHeaderConnIDLen int) ([]*unpackedPacket, []byte, error)
+}
+
+// headerDecryptor removes header protection from a packet.
+type headerDecryptor interface {
+	DecryptHeader(sample []byte, firstByte *byte, pnBytes []byte)
+}
+
+// packetUnpacker unpacks QUIC packets.
+type packetUnpacker struct {
+	cs      handshake.CryptoSetup
+	version protocol.VersionNumber
+
+	largestRcvdPacketNumber protocol.PacketNumber
+
+	// 1-RTT key update state (RFC 9001, section 6).
+	keyPhase           protocol.KeyPhaseBit
+	handshakeConfirmed bool
+	pto                time.Duration
+	keyPhaseUpdatedAt  time.Time
+
+	// prevOpener decrypts 1-RTT packets still using the key phase that was
+	// retired by the most recent key update. It's kept around until
+	// prevOpenerExpiry (indefinitely while no PTO is set) to decrypt packets
+	// reordered across the update (RFC 9001, section 6.5), and is nil before
+	// the first key update.
+	prevOpener       handshake.Opener
+	prevOpenerExpiry time.Time
+}
+
+var _ unpacker = &packetUnpacker{}
+
+func newPacketUnpacker(cs handshake.CryptoSetup, version protocol.VersionNumber) unpacker {
+	return &packetUnpacker{
+		cs:      cs,
+		version: version,
+	}
+}
+
+// SetHandshakeConfirmed is called once the handshake is confirmed (RFC 9001,
+// section 4.1.2). Key updates received before this point are rejected.
+func (u *packetUnpacker) SetHandshakeConfirmed() {
+	u.handshakeConfirmed = true
+}
+
+// SetPTO tells the unpacker about the current probe timeout estimate, so it
+// can enforce that a key update doesn't happen more than once per PTO
+// (RFC 9001, section 6.3).
+func (u *packetUnpacker) SetPTO(pto time.Duration) {
+	u.pto = pto
+}
+
+// Unpack unpacks a packet. For a long-header packet, it returns an error if
+// data is shorter than the parsed header's Length field claims, and ignores
+// any bytes beyond that length.
+func (u *packetUnpacker) Unpack(hdr *wire.Header, data []byte) (*unpackedPacket, error) {
+	if hdr.IsLongHeader {
+		if protocol.ByteCount(len(data)) < hdr.ParsedLen()+hdr.Length {
+			return nil, fmt.Errorf(
+				"packet length (%d bytes) is smaller than the expected length (%d bytes)",
+				protocol.ByteCount(len(data))-hdr.ParsedLen(), hdr.Length,
+			)
+		}
+		data = data[:hdr.ParsedLen()+hdr.Length]
+	}
+
+	encLevel := encryptionLevelForPacketType(hdr.Type)
+	if encLevel == protocol.Encryption1RTT {
+		return u.unpack1RTT(hdr, data)
+	}
+
+	opener, err := u.cs.GetOpener(encLevel)
+	if err != nil {
+		return nil, qerr.Error(qerr.DecryptionFailure, err.Error())
+	}
+
+	extHdr, packetNumber, hdrLen, err := u.unpackHeader(opener, hdr, data)
+	if err != nil {
+		return nil, qerr.Error(qerr.DecryptionFailure, err.Error())
+	}
+
+	decrypted, err := opener.Open(nil, data[hdrLen:], packetNumber, data[:hdrLen])
+	if err != nil {
+		return nil, qerr.Error(qerr.DecryptionFailure, err.Error())
+	}
+	if len(decrypted) == 0 {
+		return nil, qerr.MissingPayload
+	}
+
+	if packetNumber > u.largestRcvdPacketNumber {
+		u.largestRcvdPacketNumber = packetNumber
+	}
+
+	frames, err := u.parseFrames(decrypted, encLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unpackedPacket{
+		hdr:             extHdr,
+		packetNumber:    packetNumber,
+		encryptionLevel: encLevel,
+		frames:          frames,
+	}, nil
+}
+
+// unpack1RTT unpacks a short header packet, tracking the Key Phase bit
+// (RFC 9001, section 6) to detect and perform key updates. A Key Phase bit
+// that doesn't match the current phase is ambiguous: it's one bit, so it
+// reads the same whether the packet is a genuine update to the next
+// generation or a reordered packet still using the generation retired by the
+// previous update. u.prevOpener, when not yet expired, is tried first for
+// that second case before the packet is treated as a new key update attempt.
+func (u *packetUnpacker) unpack1RTT(hdr *wire.Header, data []byte) (*unpackedPacket, error) {
+	opener, nextOpener, err := u.cs.GetOpener1RTT(u.keyPhase)
+	if err != nil {
+		return nil, qerr.Error(qerr.DecryptionFailure, err.Error())
+	}
+
+	extHdr, packetNumber, hdrLen, err := u.unpackHeader(opener, hdr, data)
+	if err != nil {
+		return nil, qerr.Error(qerr.DecryptionFailure, err.Error())
+	}
+	keyPhase := protocol.KeyPhaseBit((data[0] >> 2) & 0x1)
+
+	var decrypted []byte
+	var updatingKey bool
+	switch {
+	case keyPhase == u.keyPhase:
+		decrypted, err = opener.Open(nil, data[hdrLen:], packetNumber, data[:hdrLen])
+	case u.prevOpener != nil && (u.pto <= 0 || time.Now().Before(u.prevOpenerExpiry)):
+		decrypted, err = u.prevOpener.Open(nil, data[hdrLen:], packetNumber, data[:hdrLen])
+		if err != nil {
+			updatingKey = true
+		}
+	default:
+		updatingKey = true
+	}
+
+	if updatingKey {
+		if !u.handshakeConfirmed {
+			return nil, qerr.Error(qerr.KeyUpdateError, "received a key update before the handshake was confirmed")
+		}
+		if !u.keyPhaseUpdatedAt.IsZero() && u.pto > 0 && time.Since(u.keyPhaseUpdatedAt) < u.pto {
+			return nil, qerr.Error(qerr.KeyUpdateError, "received a key update less than a PTO after the last one")
+		}
+		if decrypted, err = nextOpener.Open(nil, data[hdrLen:], packetNumber, data[:hdrLen]); err != nil {
+			return nil, qerr.Error(qerr.KeyUpdateError, err.Error())
+		}
+	} else if err != nil {
+		return nil, qerr.Error(qerr.DecryptionFailure, err.Error())
+	}
+	if len(decrypted) == 0 {
+		return nil, qerr.MissingPayload
+	}
+
+	if updatingKey {
+		u.prevOpener = opener
+		u.prevOpenerExpiry = time.Now().Add(3 * u.pto)
+		u.keyPhase = keyPhase
+		u.keyPhaseUpdatedAt = time.Now()
+	}
+	if packetNumber > u.largestRcvdPacketNumber {
+		u.largestRcvdPacketNumber = packetNumber
+	}
+
+	frames, err := u.parseFrames(decrypted, protocol.Encryption1RTT)
+	if err != nil {
+		return nil, err
+	}
+
+	return &unpackedPacket{
+		hdr:             extHdr,
+		packetNumber:    packetNumber,
+		encryptionLevel: protocol.Encryption1RTT,
+		frames:          frames,
+	}, nil
+}
+
+// UnpackAll unpacks every packet in data, which may be a single packet or
+// several packets coalesced into one UDP datagram (RFC 9000, section 12.2).
+// Long-header packets are bounded by their Length field, so the remainder of
+// data is handed back to parse the next packet; a short-header (1-RTT)
+// packet is always the last one in a datagram, since it has no length
+// prefix of its own. If a later packet in the group fails to unpack, the
+// packets already unpacked are still returned, together with the error and
+// the remainder of data, starting at the packet that failed.
+func (u *packetUnpacker) UnpackAll(data []byte, shortHeaderConnIDLen int) ([]*unpackedPacket, []byte, error) {
+	var packets []*unpackedPacket
+	for len(data) > 0 {
+		hdr, err := wire.ParseHeader(bytes.NewReader(data), shortHeaderConnIDLen)
+		if err != nil {
+			return packets, data, err
+		}
+
+		packetLen := len(data)
+		if hdr.IsLongHeader {
+			if l := hdr.ParsedLen() + hdr.Length; protocol.ByteCount(packetLen) > l {
+				packetLen = int(l)
+			}
+		}
+
+		packet, err := u.Unpack(hdr, data[:packetLen])
+		if err != nil {
+			return packets, data, err
+		}
+		packets = append(packets, packet)
+
+		if !hdr.IsLongHeader {
+			return packets, nil, nil
+		}
+		data = data[packetLen:]
+	}
+	return packets, nil, nil
+}
+
+// unpackHeader removes header protection, decodes the packet number and
+// returns the length of the (now fully decoded) header.
+func (u *packetUnpacker) unpackHeader(opener headerDecryptor, hdr *wire.Header, data []byte) (*wire.ExtendedHeader, protocol.PacketNumber, int, error) {
+	pnOffset := int(hdr.ParsedLen())
+	// The sample used for header protection is taken 4 bytes after the start
+	// of the (up to 4 byte long) packet number, irrespective of its actual
+	// length, which isn't known until the protection is removed. Both the
+	// packet number and the sample must be fully present before calling
+	// DecryptHeader: real header protection removal (AES-ECB/ChaCha20 mask
+	// generation) requires a full headerProtectionSampleLen-byte sample and
+	// isn't safe to call with less, so truncating it down here instead of
+	// erroring would crash on a short packet.
+	if len(data) < pnOffset+4+headerProtectionSampleLen {
+		return nil, 0, 0, fmt.Errorf("packet too small to contain a valid sample")
+	}
+	pnEnd := pnOffset + 4
+	pnBytes := data[pnOffset:pnEnd]
+	sample := data[pnEnd : pnEnd+headerProtectionSampleLen]
+	opener.DecryptHeader(sample, &data[0], pnBytes)
+
+	pnLen := protocol.PacketNumberLen(data[0]&0x3) + 1
+	hdrLen := pnOffset + int(pnLen)
+
+	truncated := decodeTruncatedPacketNumber(pnBytes[:pnLen])
+	packetNumber := protocol.DecodePacketNumber(pnLen, u.largestRcvdPacketNumber, truncated)
+
+	extHdr := &wire.ExtendedHeader{
+		Header:          *hdr,
+		PacketNumber:    packetNumber,
+		PacketNumberLen: pnLen,
+	}
+	return extHdr, packetNumber, hdrLen, nil
+}
+
+func (u *packetUnpacker) parseFrames(data []byte, encLevel protocol.EncryptionLevel) ([]wire.Frame, error) {
+	r := bytes.NewReader(data)
+	var frames []wire.Frame
+	for {
+		frame, err := wire.ParseNextFrame(r, encLevel, u.version)
+		if err != nil {
+			return nil, qerr.Error(qerr.FrameEncodingError, err.Error())
+		}
+		if frame == nil {
+			break
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
+
+func encryptionLevelForPacketType(t protocol.PacketType) protocol.EncryptionLevel {
+	switch t {
+	case protocol.PacketTypeInitial:
+		return protocol.EncryptionInitial
+	case protocol.PacketTypeHandshake:
+		return protocol.EncryptionHandshake
+	default:
+		return protocol.Encryption1RTT
+	}
+}
+
+func decodeTruncatedPacketNumber(b []byte) protocol.PacketNumber {
+	var n uint64
+	for _, v := range b {
+		n = n<<8 | uint64(v)
+	}
+	return protocol.PacketNumber(n)
+}
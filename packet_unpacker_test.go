@@ -45,7 +45,7 @@ var _ = Describe("Packet Unpacker", func() {
 		data := append(hdrRaw, []byte("foobar")...) // add some payload
 		// return an empty (unencrypted) payload
 		opener := mocks.NewMockOpener(mockCtrl)
-		cs.EXPECT().GetOpener(protocol.Encryption1RTT).Return(opener, nil)
+		cs.EXPECT().GetOpener1RTT(protocol.KeyPhaseZero).Return(opener, opener, nil)
 		opener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
 		opener.EXPECT().Open(gomock.Any(), []byte("foobar"), extHdr.PacketNumber, hdrRaw).Return([]byte{}, nil)
 		_, err := unpacker.Unpack(hdr, data)
@@ -124,7 +124,7 @@ var _ = Describe("Packet Unpacker", func() {
 			PacketNumberLen: 2,
 		}
 		hdr, hdrRaw := getHeader(extHdr)
-		cs.EXPECT().GetOpener(protocol.Encryption1RTT).Return(nil, errors.New("test err"))
+		cs.EXPECT().GetOpener1RTT(protocol.KeyPhaseZero).Return(nil, nil, errors.New("test err"))
 		_, err := unpacker.Unpack(hdr, hdrRaw)
 		Expect(err).To(MatchError(qerr.Error(qerr.DecryptionFailure, "test err")))
 	})
@@ -193,6 +193,62 @@ var _ = Describe("Packet Unpacker", func() {
 		Expect(packet.packetNumber).To(Equal(protocol.PacketNumber(0x1337)))
 	})
 
+	It("updates to the next key phase when the key phase bit flips", func() {
+		unpacker.SetHandshakeConfirmed()
+		extHdr := &wire.ExtendedHeader{
+			Header:          wire.Header{DestConnectionID: connID},
+			KeyPhase:        protocol.KeyPhaseOne,
+			PacketNumber:    0x1337,
+			PacketNumberLen: 2,
+		}
+		hdr, hdrRaw := getHeader(extHdr)
+		opener := mocks.NewMockOpener(mockCtrl)
+		nextOpener := mocks.NewMockOpener(mockCtrl)
+		cs.EXPECT().GetOpener1RTT(protocol.KeyPhaseZero).Return(opener, nextOpener, nil)
+		opener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		nextOpener.EXPECT().Open(gomock.Any(), gomock.Any(), extHdr.PacketNumber, hdrRaw).Return([]byte{0}, nil)
+		packet, err := unpacker.Unpack(hdr, append(hdrRaw, make([]byte, 20)...)) // long enough for the header protection sample
+		Expect(err).ToNot(HaveOccurred())
+		Expect(packet.packetNumber).To(Equal(protocol.PacketNumber(0x1337)))
+		Expect(unpacker.keyPhase).To(Equal(protocol.KeyPhaseOne))
+	})
+
+	It("rejects a key update when decryption with the next generation key also fails", func() {
+		unpacker.SetHandshakeConfirmed()
+		extHdr := &wire.ExtendedHeader{
+			Header:          wire.Header{DestConnectionID: connID},
+			KeyPhase:        protocol.KeyPhaseOne,
+			PacketNumber:    0x1337,
+			PacketNumberLen: 2,
+		}
+		hdr, hdrRaw := getHeader(extHdr)
+		opener := mocks.NewMockOpener(mockCtrl)
+		nextOpener := mocks.NewMockOpener(mockCtrl)
+		cs.EXPECT().GetOpener1RTT(protocol.KeyPhaseZero).Return(opener, nextOpener, nil)
+		opener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		nextOpener.EXPECT().Open(gomock.Any(), gomock.Any(), extHdr.PacketNumber, hdrRaw).Return(nil, errors.New("decryption failed"))
+		_, err := unpacker.Unpack(hdr, append(hdrRaw, make([]byte, 20)...)) // long enough for the header protection sample
+		Expect(err).To(MatchError(qerr.Error(qerr.KeyUpdateError, "decryption failed")))
+		Expect(unpacker.keyPhase).To(Equal(protocol.KeyPhaseZero))
+	})
+
+	It("rejects a key update before the handshake is confirmed", func() {
+		extHdr := &wire.ExtendedHeader{
+			Header:          wire.Header{DestConnectionID: connID},
+			KeyPhase:        protocol.KeyPhaseOne,
+			PacketNumber:    0x1337,
+			PacketNumberLen: 2,
+		}
+		hdr, hdrRaw := getHeader(extHdr)
+		opener := mocks.NewMockOpener(mockCtrl)
+		nextOpener := mocks.NewMockOpener(mockCtrl)
+		cs.EXPECT().GetOpener1RTT(protocol.KeyPhaseZero).Return(opener, nextOpener, nil)
+		opener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		_, err := unpacker.Unpack(hdr, append(hdrRaw, make([]byte, 20)...)) // long enough for the header protection sample
+		Expect(err).To(HaveOccurred())
+		Expect(unpacker.keyPhase).To(Equal(protocol.KeyPhaseZero))
+	})
+
 	It("decodes the packet number", func() {
 		firstHdr := &wire.ExtendedHeader{
 			Header:          wire.Header{DestConnectionID: connID},
@@ -200,7 +256,7 @@ var _ = Describe("Packet Unpacker", func() {
 			PacketNumberLen: 2,
 		}
 		opener := mocks.NewMockOpener(mockCtrl)
-		cs.EXPECT().GetOpener(protocol.Encryption1RTT).Return(opener, nil).Times(2)
+		cs.EXPECT().GetOpener1RTT(protocol.KeyPhaseZero).Return(opener, opener, nil).Times(2)
 		opener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
 		opener.EXPECT().Open(gomock.Any(), gomock.Any(), firstHdr.PacketNumber, gomock.Any()).Return([]byte{0}, nil)
 		packet, err := unpacker.Unpack(getHeader(firstHdr))
@@ -232,10 +288,145 @@ var _ = Describe("Packet Unpacker", func() {
 		hdr, hdrRaw := getHeader(extHdr)
 		opener := mocks.NewMockOpener(mockCtrl)
 		opener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
-		cs.EXPECT().GetOpener(protocol.Encryption1RTT).Return(opener, nil)
+		cs.EXPECT().GetOpener1RTT(protocol.KeyPhaseZero).Return(opener, opener, nil)
 		opener.EXPECT().Open(gomock.Any(), gomock.Any(), extHdr.PacketNumber, hdrRaw).Return(buf.Bytes(), nil)
 		packet, err := unpacker.Unpack(hdr, append(hdrRaw, buf.Bytes()...))
 		Expect(err).ToNot(HaveOccurred())
 		Expect(packet.frames).To(Equal([]wire.Frame{&wire.PingFrame{}, &wire.DataBlockedFrame{}}))
 	})
+
+	It("unpacks a coalesced Initial + Handshake datagram", func() {
+		initialHdr := &wire.ExtendedHeader{
+			Header: wire.Header{
+				IsLongHeader:     true,
+				Type:             protocol.PacketTypeInitial,
+				Length:           3 + 24,
+				DestConnectionID: connID,
+				Version:          version,
+			},
+			PacketNumber:    2,
+			PacketNumberLen: 3,
+		}
+		_, initialRaw := getHeader(initialHdr)
+		initialPacket := append(initialRaw, bytes.Repeat([]byte("foobar"), 4)...)
+
+		handshakeHdr := &wire.ExtendedHeader{
+			Header: wire.Header{
+				IsLongHeader:     true,
+				Type:             protocol.PacketTypeHandshake,
+				Length:           2 + 24,
+				DestConnectionID: connID,
+				Version:          version,
+			},
+			PacketNumber:    3,
+			PacketNumberLen: 2,
+		}
+		_, handshakeRaw := getHeader(handshakeHdr)
+		handshakePacket := append(handshakeRaw, bytes.Repeat([]byte("barfoo"), 4)...)
+
+		initialOpener := mocks.NewMockOpener(mockCtrl)
+		cs.EXPECT().GetOpener(protocol.EncryptionInitial).Return(initialOpener, nil)
+		initialOpener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		initialOpener.EXPECT().Open(gomock.Any(), bytes.Repeat([]byte("foobar"), 4), initialHdr.PacketNumber, initialRaw).Return([]byte{0}, nil)
+
+		handshakeOpener := mocks.NewMockOpener(mockCtrl)
+		cs.EXPECT().GetOpener(protocol.EncryptionHandshake).Return(handshakeOpener, nil)
+		handshakeOpener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		handshakeOpener.EXPECT().Open(gomock.Any(), bytes.Repeat([]byte("barfoo"), 4), handshakeHdr.PacketNumber, handshakeRaw).Return([]byte{0}, nil)
+
+		packets, rest, err := unpacker.UnpackAll(append(initialPacket, handshakePacket...), connID.Len())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rest).To(BeEmpty())
+		Expect(packets).To(HaveLen(2))
+		Expect(packets[0].encryptionLevel).To(Equal(protocol.EncryptionInitial))
+		Expect(packets[1].encryptionLevel).To(Equal(protocol.EncryptionHandshake))
+	})
+
+	It("treats a trailing short-header packet as terminal in a coalesced datagram", func() {
+		initialHdr := &wire.ExtendedHeader{
+			Header: wire.Header{
+				IsLongHeader:     true,
+				Type:             protocol.PacketTypeInitial,
+				Length:           3 + 24,
+				DestConnectionID: connID,
+				Version:          version,
+			},
+			PacketNumber:    2,
+			PacketNumberLen: 3,
+		}
+		_, initialRaw := getHeader(initialHdr)
+		initialPacket := append(initialRaw, bytes.Repeat([]byte("foobar"), 4)...)
+
+		shortHdrExt := &wire.ExtendedHeader{
+			Header:          wire.Header{DestConnectionID: connID},
+			PacketNumber:    4,
+			PacketNumberLen: 2,
+		}
+		_, shortRaw := getHeader(shortHdrExt)
+		shortPacket := append(shortRaw, bytes.Repeat([]byte("barfoo"), 4)...)
+
+		initialOpener := mocks.NewMockOpener(mockCtrl)
+		cs.EXPECT().GetOpener(protocol.EncryptionInitial).Return(initialOpener, nil)
+		initialOpener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		initialOpener.EXPECT().Open(gomock.Any(), bytes.Repeat([]byte("foobar"), 4), initialHdr.PacketNumber, initialRaw).Return([]byte{0}, nil)
+
+		oneRTTOpener := mocks.NewMockOpener(mockCtrl)
+		cs.EXPECT().GetOpener1RTT(protocol.KeyPhaseZero).Return(oneRTTOpener, oneRTTOpener, nil)
+		oneRTTOpener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		oneRTTOpener.EXPECT().Open(gomock.Any(), bytes.Repeat([]byte("barfoo"), 4), shortHdrExt.PacketNumber, shortRaw).Return([]byte{0}, nil)
+
+		packets, rest, err := unpacker.UnpackAll(append(initialPacket, shortPacket...), connID.Len())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(rest).To(BeEmpty())
+		Expect(packets).To(HaveLen(2))
+		Expect(packets[0].encryptionLevel).To(Equal(protocol.EncryptionInitial))
+		Expect(packets[1].encryptionLevel).To(Equal(protocol.Encryption1RTT))
+	})
+
+	It("keeps already-unpacked packets when a later packet in a coalesced datagram fails", func() {
+		initialHdr := &wire.ExtendedHeader{
+			Header: wire.Header{
+				IsLongHeader:     true,
+				Type:             protocol.PacketTypeInitial,
+				Length:           3 + 24,
+				DestConnectionID: connID,
+				Version:          version,
+			},
+			PacketNumber:    2,
+			PacketNumberLen: 3,
+		}
+		_, initialRaw := getHeader(initialHdr)
+		initialPacket := append(initialRaw, bytes.Repeat([]byte("foobar"), 4)...)
+
+		handshakeHdr := &wire.ExtendedHeader{
+			Header: wire.Header{
+				IsLongHeader:     true,
+				Type:             protocol.PacketTypeHandshake,
+				Length:           2 + 24,
+				DestConnectionID: connID,
+				Version:          version,
+			},
+			PacketNumber:    3,
+			PacketNumberLen: 2,
+		}
+		_, handshakeRaw := getHeader(handshakeHdr)
+		handshakePacket := append(handshakeRaw, bytes.Repeat([]byte("barfoo"), 4)...)
+
+		initialOpener := mocks.NewMockOpener(mockCtrl)
+		cs.EXPECT().GetOpener(protocol.EncryptionInitial).Return(initialOpener, nil)
+		initialOpener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		initialOpener.EXPECT().Open(gomock.Any(), bytes.Repeat([]byte("foobar"), 4), initialHdr.PacketNumber, initialRaw).Return([]byte{0}, nil)
+
+		handshakeOpener := mocks.NewMockOpener(mockCtrl)
+		cs.EXPECT().GetOpener(protocol.EncryptionHandshake).Return(handshakeOpener, nil)
+		handshakeOpener.EXPECT().DecryptHeader(gomock.Any(), gomock.Any(), gomock.Any())
+		handshakeOpener.EXPECT().Open(gomock.Any(), bytes.Repeat([]byte("barfoo"), 4), handshakeHdr.PacketNumber, handshakeRaw).Return(nil, errors.New("decryption failed"))
+
+		data := append(initialPacket, handshakePacket...)
+		packets, rest, err := unpacker.UnpackAll(data, connID.Len())
+		Expect(err).To(HaveOccurred())
+		Expect(rest).To(Equal(data[len(initialPacket):]))
+		Expect(packets).To(HaveLen(1))
+		Expect(packets[0].encryptionLevel).To(Equal(protocol.EncryptionInitial))
+	})
 })